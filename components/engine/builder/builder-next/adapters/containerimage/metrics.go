@@ -0,0 +1,58 @@
+package containerimage
+
+import (
+	"context"
+	"io"
+
+	"github.com/docker/docker/builder/builder-next/exemplar"
+	"github.com/docker/go-metrics"
+)
+
+// pulledBytesName is the name of pulledBytes in the Prometheus text format
+const pulledBytesName = "builder_buildkit_pulled_bytes_total"
+
+var pulledBytes metrics.Counter
+
+func init() {
+	ns := metrics.NewNamespace("builder", "buildkit", nil)
+	pulledBytes = ns.NewCounter("pulled_bytes", "The number of bytes of image layers pulled from registries")
+	metrics.Register(ns)
+}
+
+// countingReader adds the bytes read from Reader to pulledBytes. The total
+// is recorded as an exemplar of the trace in ctx when Reader is read to the
+// end.
+type countingReader struct {
+	io.Reader
+	ctx  context.Context
+	n    int64
+	done bool
+}
+
+// countingReadSeeker is a countingReader that can seek, so that writes to
+// the content store can resume partial downloads
+type countingReadSeeker struct {
+	countingReader
+	io.Seeker
+}
+
+// newCountingReader returns a countingReader for r, seeking if r does
+func newCountingReader(ctx context.Context, r io.Reader) io.Reader {
+	if s, ok := r.(io.Seeker); ok {
+		return &countingReadSeeker{countingReader: countingReader{Reader: r, ctx: ctx}, Seeker: s}
+	}
+	return &countingReader{Reader: r, ctx: ctx}
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		pulledBytes.Inc(float64(n))
+		r.n += int64(n)
+	}
+	if err == io.EOF && !r.done {
+		r.done = true
+		exemplar.Observe(r.ctx, pulledBytesName, float64(r.n))
+	}
+	return n, err
+}
@@ -31,8 +31,10 @@ import (
 	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/session/auth"
 	"github.com/moby/buildkit/source"
+	"github.com/moby/buildkit/util/contentutil"
 	"github.com/moby/buildkit/util/flightcontrol"
 	"github.com/moby/buildkit/util/imageutil"
+	"github.com/moby/buildkit/util/registrymirror"
 	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/util/tracing"
 	digest "github.com/opencontainers/go-digest"
@@ -71,29 +73,20 @@ func (is *imageSource) ID() string {
 	return source.DockerImageScheme
 }
 
+// getResolver returns the resolver of the build of ctx, which goes through
+// the registry mirrors of the build if it has any
 func (is *imageSource) getResolver(ctx context.Context) remotes.Resolver {
-	return docker.NewResolver(docker.ResolverOptions{
-		Client:      tracing.DefaultClient,
-		Credentials: is.getCredentialsFromSession(ctx),
-	})
-}
-
-func (is *imageSource) getCredentialsFromSession(ctx context.Context) func(string) (string, string, error) {
-	id := session.FromContext(ctx)
-	if id == "" {
-		return nil
+	newResolver := func(plainHTTP bool) remotes.Resolver {
+		return docker.NewResolver(docker.ResolverOptions{
+			Client:      tracing.DefaultClient,
+			Credentials: auth.SessionCredentialsFunc(ctx, is.SessionManager),
+			PlainHTTP:   plainHTTP,
+		})
 	}
-	return func(host string) (string, string, error) {
-		timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		caller, err := is.SessionManager.Get(timeoutCtx, id)
-		if err != nil {
-			return "", "", err
-		}
-
-		return auth.CredentialsFunc(tracing.ContextWithSpanFromContext(context.TODO(), ctx), caller)(host)
+	if c, ok := registrymirror.FromContext(ctx); ok {
+		return registrymirror.NewResolver(c, newResolver)
 	}
+	return newResolver(false)
 }
 
 func (is *imageSource) resolveLocal(refStr string) ([]byte, error) {
@@ -267,6 +260,17 @@ func (p *puller) resolve(ctx context.Context) error {
 				resolveProgressDone(err)
 				return
 			}
+			// the registry may serve another manifest than the one the
+			// reference is pinned to
+			if dgst := p.src.Reference.Digest(); dgst != "" && desc.Digest != dgst {
+				p.resolveErr = errors.WithStack(&source.ChecksumMismatchError{
+					Source:   p.src.Reference.String(),
+					Expected: dgst.String(),
+					Actual:   desc.Digest.String(),
+				})
+				resolveProgressDone(p.resolveErr)
+				return
+			}
 
 			p.desc = desc
 			p.ref = origRef
@@ -328,6 +332,57 @@ func (p *puller) CacheKey(ctx context.Context, index int) (string, bool, error)
 	return cacheKeyFromConfig(p.config).String(), true, nil
 }
 
+// PullSize implements source.PullSizer. It is the size of the layers of the
+// image that were never pulled before, 0 if the image exists locally.
+// Schema 1 images are not estimated.
+func (p *puller) PullSize(ctx context.Context) (int64, bool, error) {
+	p.resolveLocal()
+	if err := p.resolve(ctx); err != nil {
+		return 0, false, err
+	}
+	if p.config != nil {
+		if _, err := p.is.ImageStore.Get(image.ID(digest.FromBytes(p.config))); err == nil {
+			return 0, true, nil
+		}
+	}
+	if p.desc.MediaType == images.MediaTypeDockerSchema1Manifest {
+		return 0, false, nil
+	}
+	fetcher, err := p.resolver.Fetcher(ctx, p.ref)
+	if err != nil {
+		return 0, false, err
+	}
+	mfst, err := images.Manifest(ctx, contentutil.FromFetcher(fetcher), p.desc, platforms.Default())
+	if err != nil {
+		return 0, false, err
+	}
+	var size int64
+	for _, desc := range mfst.Layers {
+		if _, err := p.is.MetadataStore.GetDiffID(desc.Digest); err == nil {
+			continue
+		}
+		size += desc.Size
+	}
+	return size, true, nil
+}
+
+// Pin implements source.Pinner. It is the digest of the manifest that the
+// reference resolves to in the registry, even if the image exists locally.
+func (p *puller) Pin(ctx context.Context) (string, error) {
+	if dgst := p.src.Reference.Digest(); dgst != "" {
+		return dgst.String(), nil
+	}
+	ref, err := distreference.ParseNormalizedNamed(p.src.Reference.String())
+	if err != nil {
+		return "", err
+	}
+	_, desc, err := p.resolver.Resolve(ctx, ref.String())
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
 func (p *puller) Snapshot(ctx context.Context) (cache.ImmutableRef, error) {
 	p.resolveLocal()
 	if err := p.resolve(ctx); err != nil {
@@ -503,13 +558,26 @@ func (p *puller) Snapshot(ctx context.Context) (cache.ImmutableRef, error) {
 		}
 	}()
 
+	// concurrent pulls of the same layers by other jobs share the transfers
+	// of the download manager
 	r := image.NewRootFS()
 	rootFS, release, err := p.is.DownloadManager.Download(ctx, *r, runtime.GOOS, layers, pkgprogress.ChanOutput(pchan))
 	if err != nil {
+		if ctx.Err() == nil {
+			// the transfers failed for all jobs, drop their partial content
+			for _, desc := range mfst.Layers {
+				p.is.ContentStore.Abort(context.TODO(), remotes.MakeRefKey(ctx, desc))
+			}
+		}
 		return nil, err
 	}
 	stopProgress()
 
+	if err := verifyDiffIDs(rootFS.DiffIDs, img.RootFS.DiffIDs); err != nil {
+		release()
+		return nil, errors.Wrapf(err, "failed to verify layers of %s", p.ref)
+	}
+
 	ref, err := p.is.CacheAccessor.GetFromSnapshotter(ctx, string(rootFS.ChainID()), cache.WithDescription(fmt.Sprintf("pulled from %s", p.ref)))
 	release()
 	if err != nil {
@@ -519,6 +587,20 @@ func (p *puller) Snapshot(ctx context.Context) (cache.ImmutableRef, error) {
 	return ref, nil
 }
 
+// verifyDiffIDs checks that the unpacked layers have the diff IDs of the
+// image config
+func verifyDiffIDs(layers []layer.DiffID, config []digest.Digest) error {
+	if len(layers) != len(config) {
+		return errors.Errorf("got %d layers, the config has %d", len(layers), len(config))
+	}
+	for i, diffID := range layers {
+		if digest.Digest(diffID) != config[i] {
+			return errors.Errorf("layer %d has diff ID %s, the config has %s", i, diffID, config[i])
+		}
+	}
+	return nil
+}
+
 // Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error)
 type layerDescriptor struct {
 	is      *imageSource
@@ -549,10 +631,15 @@ func (ld *layerDescriptor) Download(ctx context.Context, progressOutput pkgprogr
 
 	refKey := remotes.MakeRefKey(ctx, ld.desc)
 
-	ld.is.ContentStore.Abort(ctx, refKey)
-
-	if err := content.WriteBlob(ctx, ld.is.ContentStore, refKey, rc, ld.desc); err != nil {
-		ld.is.ContentStore.Abort(ctx, refKey)
+	// The ingest of an earlier attempt that failed is kept and resumed from
+	// its offset, the registry fetcher seeks with a range request. The
+	// content is verified against the digest when it is committed, before
+	// it is unpacked.
+	if err := content.WriteBlob(ctx, ld.is.ContentStore, refKey, newCountingReader(ctx, rc), ld.desc); err != nil {
+		if errdefs.IsFailedPrecondition(err) {
+			// the content doesn't match the descriptor, start over
+			ld.is.ContentStore.Abort(ctx, refKey)
+		}
 		return nil, 0, err
 	}
 
@@ -736,9 +823,11 @@ func oneOffProgress(ctx context.Context, id string) func(err error) error {
 	}
 	pw.Write(id, st)
 	return func(err error) error {
-		// TODO: set error on status
 		now := time.Now()
 		st.Completed = &now
+		if err != nil {
+			st.Error = err.Error()
+		}
 		pw.Write(id, st)
 		pw.Close()
 		return err
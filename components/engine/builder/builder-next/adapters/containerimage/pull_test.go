@@ -0,0 +1,99 @@
+package containerimage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/moby/buildkit/source"
+	"github.com/moby/buildkit/util/registrymirror"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+func TestResolverPullsThroughMirror(t *testing.T) {
+	manifest := []byte(`{"schemaVersion":2}`)
+	dgst := digest.FromBytes(manifest)
+
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/v2/library/busybox/manifests/latest", "/v2/library/busybox/manifests/" + dgst.String():
+			w.Header().Set("Content-Type", images.MediaTypeDockerSchema2Manifest)
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+				return
+			}
+			w.Write(manifest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	mirror := strings.TrimPrefix(srv.URL, "http://")
+	ctx := registrymirror.WithConfig(context.Background(), registrymirror.Config{
+		Mirrors:  map[string][]string{"docker.io": {mirror}},
+		Insecure: []string{mirror},
+	})
+	resolver := (&imageSource{}).getResolver(ctx)
+
+	ref, desc, err := resolver.Resolve(ctx, "docker.io/library/busybox:latest")
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(dgst, desc.Digest))
+
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	assert.NilError(t, err)
+	rc, err := fetcher.Fetch(ctx, desc)
+	assert.NilError(t, err)
+	defer rc.Close()
+	dt, err := ioutil.ReadAll(rc)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(manifest, dt))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Check(t, is.Contains(requests, "GET /v2/library/busybox/manifests/"+dgst.String()))
+}
+
+func TestResolveFailsOnPinMismatch(t *testing.T) {
+	pinned := digest.FromString("pinned")
+	served := digest.FromString("served")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/library/busybox/manifests/"+pinned.String() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", images.MediaTypeDockerSchema2Manifest)
+		w.Header().Set("Docker-Content-Digest", served.String())
+		w.Header().Set("Content-Length", "0")
+	}))
+	defer srv.Close()
+
+	id, err := source.NewImageIdentifier(strings.TrimPrefix(srv.URL, "http://") + "/library/busybox:latest@" + pinned.String())
+	assert.NilError(t, err)
+	p := &puller{
+		is:       &imageSource{},
+		src:      id,
+		resolver: docker.NewResolver(docker.ResolverOptions{PlainHTTP: true}),
+	}
+	err = p.resolve(context.Background())
+	mismatch, ok := errors.Cause(err).(*source.ChecksumMismatchError)
+	assert.Assert(t, ok, "unexpected error %v", err)
+	assert.Check(t, is.Equal(pinned.String(), mismatch.Expected))
+	assert.Check(t, is.Equal(served.String(), mismatch.Actual))
+}
@@ -17,9 +17,13 @@ import (
 	"github.com/docker/docker/pkg/system"
 	controlapi "github.com/moby/buildkit/api/services/control"
 	"github.com/moby/buildkit/control"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/solver/llbsolver"
+	"github.com/moby/buildkit/util/entitlements"
 	"github.com/moby/buildkit/util/tracing"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
 	grpcmetadata "google.golang.org/grpc/metadata"
@@ -30,6 +34,14 @@ type Opt struct {
 	SessionManager *session.Manager
 	Root           string
 	Dist           images.DistributionServices
+	// ExportHooks are called with what a build exported before the build
+	// returns, to sign or replicate the images for example. A failing hook
+	// fails the build.
+	ExportHooks []llbsolver.ExportHook
+	// Tracer records the spans of builds, as children of the span that the
+	// client propagated in its session. Builds are not traced if it is not
+	// set.
+	Tracer opentracing.Tracer
 }
 
 // Builder can build using BuildKit backend
@@ -54,6 +66,7 @@ func New(opt Opt) (*Builder, error) {
 		reqBodyHandler: reqHandler,
 		jobs:           map[string]*buildJob{},
 	}
+	cacheUsage.set(b)
 	return b, nil
 }
 
@@ -209,6 +222,20 @@ func (b *Builder) Build(ctx context.Context, opt backend.BuildConfig) (*builder.
 		frontendAttrs["no-cache"] = ""
 	}
 
+	var ents []string
+	switch opt.Options.NetworkMode {
+	case "", "default", "bridge":
+		// exec ops use the default network of the executor
+	default:
+		if strings.HasPrefix(opt.Options.NetworkMode, "container:") {
+			return nil, errors.Errorf("network mode %q not supported by buildkit", opt.Options.NetworkMode)
+		}
+		if opt.Options.NetworkMode == "host" {
+			ents = append(ents, string(entitlements.EntitlementNetworkHost))
+		}
+		frontendAttrs["network"] = opt.Options.NetworkMode
+	}
+
 	if opt.Options.PullParent {
 		frontendAttrs["image-resolve-mode"] = "pull"
 	} else {
@@ -218,12 +245,15 @@ func (b *Builder) Build(ctx context.Context, opt backend.BuildConfig) (*builder.
 	if opt.Options.Platform != "" {
 		// same as in newBuilder in builder/dockerfile.builder.go
 		// TODO: remove once opt.Options.Platform is of type specs.Platform
-		sp, err := platforms.Parse(opt.Options.Platform)
-		if err != nil {
-			return nil, err
-		}
-		if err := system.ValidatePlatform(sp); err != nil {
-			return nil, err
+		// a comma-separated list builds an image per platform in one solve
+		for _, p := range strings.Split(opt.Options.Platform, ",") {
+			sp, err := platforms.Parse(p)
+			if err != nil {
+				return nil, err
+			}
+			if err := system.ValidatePlatform(sp); err != nil {
+				return nil, err
+			}
 		}
 		frontendAttrs["platform"] = opt.Options.Platform
 	}
@@ -241,6 +271,7 @@ func (b *Builder) Build(ctx context.Context, opt backend.BuildConfig) (*builder.
 		Frontend:      "dockerfile.v0",
 		FrontendAttrs: frontendAttrs,
 		Session:       opt.Options.SessionID,
+		Entitlements:  ents,
 	}
 
 	aux := streamformatter.AuxFormatter{Writer: opt.ProgressWriter.Output}
@@ -248,11 +279,13 @@ func (b *Builder) Build(ctx context.Context, opt backend.BuildConfig) (*builder.
 	eg, ctx := errgroup.WithContext(ctx)
 
 	eg.Go(func() error {
+		activeJobs.Inc()
 		resp, err := b.controller.Solve(ctx, req)
+		activeJobs.Dec()
 		if err != nil {
 			return err
 		}
-		id, ok := resp.ExporterResponse["containerimage.digest"]
+		id, ok := resp.ExporterResponse[exptypes.ExporterImageDigestKey]
 		if !ok {
 			return errors.Errorf("missing image id")
 		}
@@ -271,7 +304,10 @@ func (b *Builder) Build(ctx context.Context, opt backend.BuildConfig) (*builder.
 	})
 
 	eg.Go(func() error {
+		vm := newVertexMetrics()
+		defer vm.done()
 		for sr := range ch {
+			vm.update(sr)
 			dt, err := sr.Marshal()
 			if err != nil {
 				return err
@@ -13,15 +13,25 @@ import (
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/cache/remotecache"
+	gcsremotecache "github.com/moby/buildkit/cache/remotecache/gcs"
+	inlineremotecache "github.com/moby/buildkit/cache/remotecache/inline"
+	localremotecache "github.com/moby/buildkit/cache/remotecache/local"
 	registryremotecache "github.com/moby/buildkit/cache/remotecache/registry"
+	s3remotecache "github.com/moby/buildkit/cache/remotecache/s3"
+	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/control"
 	"github.com/moby/buildkit/exporter"
+	localexporter "github.com/moby/buildkit/exporter/local"
 	"github.com/moby/buildkit/frontend"
 	dockerfile "github.com/moby/buildkit/frontend/dockerfile/builder"
 	"github.com/moby/buildkit/frontend/gateway"
 	"github.com/moby/buildkit/frontend/gateway/forwarder"
+	"github.com/moby/buildkit/session"
 	"github.com/moby/buildkit/snapshot/blobmapping"
 	"github.com/moby/buildkit/solver/boltdbcachestorage"
+	"github.com/moby/buildkit/solver/llbsolver"
+	"github.com/moby/buildkit/util/entitlements"
 	"github.com/moby/buildkit/worker"
 	"github.com/pkg/errors"
 )
@@ -104,6 +114,23 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		ImageStore:     dist.ImageStore,
 		ReferenceStore: dist.ReferenceStore,
 		Differ:         differ,
+		LayerStore:     dist.LayerStore,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ociExp, err := containerimageexp.NewOCI(containerimageexp.OCIOpt{
+		SessionManager: opt.SessionManager,
+		Differ:         differ,
+		LayerStore:     dist.LayerStore,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	localExp, err := localexporter.New(localexporter.Opt{
+		SessionManager: opt.SessionManager,
 	})
 	if err != nil {
 		return nil, err
@@ -126,7 +153,9 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		DownloadManager:   dist.DownloadManager,
 		V2MetadataService: dist.V2MetadataService,
 		Exporters: map[string]exporter.Exporter{
-			"moby": exp,
+			"moby":               instrumentExporter("moby", exp),
+			client.ExporterOCI:   instrumentExporter(client.ExporterOCI, ociExp),
+			client.ExporterLocal: instrumentExporter(client.ExporterLocal, localExp),
 		},
 		Transport: rt,
 	}
@@ -143,12 +172,40 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		"gateway.v0":    gateway.NewGatewayFrontend(wc),
 	}
 
+	resolveCacheImporter := remotecache.ResolveCacheImporterByType(map[string]remotecache.ResolveCacheImporterFunc{
+		"":                         registryremotecache.ResolveCacheImporterFunc(opt.SessionManager),
+		s3remotecache.CacheType:    s3remotecache.ResolveCacheImporterFunc(opt.SessionManager),
+		gcsremotecache.CacheType:   gcsremotecache.ResolveCacheImporterFunc(opt.SessionManager),
+		localremotecache.CacheType: localremotecache.ResolveCacheImporterFunc(),
+	})
+
 	return control.NewController(control.Opt{
 		SessionManager:           opt.SessionManager,
 		WorkerController:         wc,
 		Frontends:                frontends,
 		CacheKeyStorage:          cacheStorage,
-		ResolveCacheImporterFunc: registryremotecache.ResolveCacheImporterFunc(opt.SessionManager),
-		// TODO: set ResolveCacheExporterFunc for exporting cache
+		ResolveCacheImporterFunc: resolveCacheImporter,
+		ResolveCacheExporterFunc: resolveCacheExporter(opt.SessionManager),
+		SolverOpt: llbsolver.SolverOpt{
+			ResolveRegistry: registryremotecache.ResolveRegistryFunc(opt.SessionManager),
+			History:         llbsolver.HistoryOpt{DBPath: filepath.Join(opt.Root, "history.db")},
+			// the classic builder allows --network=host too, builds still have
+			// to request it
+			AllowedEntitlements: []entitlements.Entitlement{entitlements.EntitlementNetworkHost},
+			ExportHooks:         opt.ExportHooks,
+			Tracing:             llbsolver.TracingOpt{Tracer: opt.Tracer},
+		},
+	})
+}
+
+// resolveCacheExporter returns the resolver of the cache exporters for the
+// cache types that the daemon supports
+func resolveCacheExporter(sm *session.Manager) remotecache.ResolveCacheExporterFunc {
+	return remotecache.ResolveCacheExporterByType(map[string]remotecache.ResolveCacheExporterFunc{
+		"":                          registryremotecache.ResolveCacheExporterFunc(sm),
+		s3remotecache.CacheType:     s3remotecache.ResolveCacheExporterFunc(sm),
+		gcsremotecache.CacheType:    gcsremotecache.ResolveCacheExporterFunc(sm),
+		localremotecache.CacheType:  localremotecache.ResolveCacheExporterFunc(),
+		inlineremotecache.CacheType: inlineremotecache.ResolveCacheExporterFunc(),
 	})
 }
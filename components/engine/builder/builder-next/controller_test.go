@@ -0,0 +1,107 @@
+package buildkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/util/contentutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeS3 is an S3 endpoint storing objects in memory
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // path -> content
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		dt, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		s.objects[r.URL.Path] = dt
+	case http.MethodHead, http.MethodGet:
+		dt, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(dt)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3CacheExport(t *testing.T) {
+	for k, v := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "access",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	s3 := &fakeS3{objects: map[string][]byte{}}
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	ctx := context.Background()
+	e, err := resolveCacheExporter(nil)(ctx, "s3", "bucket=cache,region=us-east-1,name=app,endpoint_url="+srv.URL)
+	assert.NilError(t, err)
+
+	layer := []byte("layer")
+	desc := ocispec.Descriptor{
+		Digest:    digest.FromBytes(layer),
+		Size:      int64(len(layer)),
+		MediaType: images.MediaTypeDockerSchema2LayerGzip,
+	}
+	buf := contentutil.NewBuffer()
+	assert.NilError(t, content.WriteBlob(ctx, buf, desc.Digest.String(), bytes.NewReader(layer), desc))
+	e.Add(digest.FromString("record")).AddResult(time.Now(), &solver.Remote{
+		Descriptors: []ocispec.Descriptor{desc},
+		Provider:    buf,
+	})
+	assert.NilError(t, e.Finalize(ctx))
+
+	dt, ok := s3.objects["/cache/blobs/sha256/"+desc.Digest.Hex()]
+	assert.Assert(t, ok, "layer blob was not written")
+	assert.Check(t, is.DeepEqual(layer, dt))
+
+	dt, ok = s3.objects["/cache/manifests/app"]
+	assert.Assert(t, ok, "cache manifest was not written")
+	var mfst ocispec.Index
+	assert.NilError(t, json.Unmarshal(dt, &mfst))
+	var layers int
+	for _, m := range mfst.Manifests {
+		if m.Digest == desc.Digest {
+			layers++
+		}
+		_, ok := s3.objects["/cache/blobs/sha256/"+m.Digest.Hex()]
+		assert.Check(t, ok, "blob %s of the manifest was not written", m.Digest)
+	}
+	assert.Check(t, is.Equal(1, layers))
+}
+
+func TestResolveCacheExporterUnknownType(t *testing.T) {
+	_, err := resolveCacheExporter(nil)(context.Background(), "unknown", "")
+	assert.Check(t, err != nil && strings.Contains(err.Error(), "unsupported cache exporter type"), err)
+}
@@ -0,0 +1,98 @@
+// Package exemplar links the observations of build metrics to the traces of
+// the builds that made them. The metrics are served with their exemplars in
+// the OpenMetrics format to the scrapers that ask for it.
+package exemplar
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// maxExemplars is the number of recent exemplars kept per series, enough to
+// have one for most of the buckets of a histogram
+const maxExemplars = 16
+
+// traceIDHeaders are the headers that tracers commonly inject the ID of
+// the trace in, and functions returning the ID from their values
+var traceIDHeaders = map[string]func(string) string{
+	// jaeger: trace-id:span-id:parent-span-id:flags
+	"uber-trace-id": func(v string) string { return strings.SplitN(v, ":", 2)[0] },
+	// W3C trace context: version-trace-id-parent-id-flags
+	"traceparent":       func(v string) string { return strings.Split(v+"--", "-")[1] },
+	"x-b3-traceid":      func(v string) string { return v },
+	"ot-tracer-traceid": func(v string) string { return v },
+}
+
+type exemplar struct {
+	traceID   string
+	value     float64
+	timestamp time.Time
+}
+
+var (
+	mu sync.Mutex
+	// series maps the keys of series to their recent exemplars, newest last
+	series = map[string][]exemplar{}
+)
+
+// TraceID returns the ID of the trace of the span in ctx, or "" if there is
+// no span or its tracer doesn't inject the trace ID in a known header
+func TraceID(ctx context.Context) string {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	carrier := opentracing.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), opentracing.TextMap, carrier); err != nil {
+		return ""
+	}
+	for k, v := range carrier {
+		if f, ok := traceIDHeaders[strings.ToLower(k)]; ok {
+			return f(v)
+		}
+	}
+	return ""
+}
+
+// Observe records value, observed for the series of the metric name with
+// labelValues, as an exemplar of the trace of the span in ctx. The label
+// values are in the order of their label names. name is the name of the
+// metric in the Prometheus text format, like
+// "builder_buildkit_pulled_bytes_total". Nothing is recorded if ctx has no
+// trace.
+func Observe(ctx context.Context, name string, value float64, labelValues ...string) {
+	traceID := TraceID(ctx)
+	if traceID == "" {
+		return
+	}
+	key := seriesKey(name, labelValues)
+	mu.Lock()
+	defer mu.Unlock()
+	s := append(series[key], exemplar{traceID: traceID, value: value, timestamp: time.Now()})
+	if len(s) > maxExemplars {
+		s = s[len(s)-maxExemplars:]
+	}
+	series[key] = s
+}
+
+func seriesKey(name string, labelValues []string) string {
+	return name + "\xff" + strings.Join(labelValues, "\xff")
+}
+
+// latest returns the newest exemplar of the series with a value in
+// (min, max]
+func latest(key string, min, max float64) (exemplar, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	s := series[key]
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i].value > min && s[i].value <= max {
+			return s[i], true
+		}
+	}
+	return exemplar{}, false
+}
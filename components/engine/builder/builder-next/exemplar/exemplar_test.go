@@ -0,0 +1,85 @@
+package exemplar
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/docker/go-metrics"
+	opentracing "github.com/opentracing/opentracing-go"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// fakeTracer injects the jaeger header with a fixed trace ID
+type fakeTracer struct {
+	opentracing.NoopTracer
+}
+
+func (t fakeTracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	return fakeSpan{Span: t.NoopTracer.StartSpan(operationName, opts...)}
+}
+
+func (t fakeTracer) Inject(sm opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	carrier.(opentracing.TextMapWriter).Set("uber-trace-id", "4bf92f3577b34da6:4bf92f3577b34da6:0:1")
+	return nil
+}
+
+type fakeSpan struct {
+	opentracing.Span
+}
+
+func (s fakeSpan) Tracer() opentracing.Tracer {
+	return fakeTracer{}
+}
+
+func TestTraceID(t *testing.T) {
+	assert.Check(t, is.Equal("", TraceID(context.Background())))
+	span := opentracing.NoopTracer{}.StartSpan("noop")
+	assert.Check(t, is.Equal("", TraceID(opentracing.ContextWithSpan(context.Background(), span))))
+	span = fakeTracer{}.StartSpan("build")
+	assert.Check(t, is.Equal("4bf92f3577b34da6", TraceID(opentracing.ContextWithSpan(context.Background(), span))))
+}
+
+func TestHandlerWritesExemplars(t *testing.T) {
+	ns := metrics.NewNamespace("exemplar", "test", nil)
+	duration := ns.NewLabeledTimer("export", "Export duration", "exporter")
+	bytes := ns.NewCounter("pulled_bytes", "Pulled bytes")
+	metrics.Register(ns)
+
+	ctx := opentracing.ContextWithSpan(context.Background(), fakeTracer{}.StartSpan("build"))
+	duration.WithValues("local").Update(300 * 1e6)
+	Observe(ctx, "exemplar_test_export_seconds", 0.3, "local")
+	bytes.Inc(1024)
+	Observe(ctx, "exemplar_test_pulled_bytes_total", 1024)
+
+	srv := httptest.NewServer(Handler(metrics.Handler()))
+	defer srv.Close()
+	get := func(accept string) (string, string) {
+		req, err := http.NewRequest("GET", srv.URL, nil)
+		assert.NilError(t, err)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+		dt, err := ioutil.ReadAll(resp.Body)
+		assert.NilError(t, err)
+		return resp.Header.Get("Content-Type"), string(dt)
+	}
+
+	ct, body := get("application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	assert.Check(t, is.Contains(ct, "application/openmetrics-text"))
+	assert.Check(t, is.Contains(body, "# TYPE exemplar_test_pulled_bytes counter\n"))
+	assert.Check(t, regexp.MustCompile(`(?m)^exemplar_test_pulled_bytes_total 1024 # \{trace_id="4bf92f3577b34da6"\} 1024 [0-9.]+$`).MatchString(body), body)
+	assert.Check(t, regexp.MustCompile(`(?m)^exemplar_test_export_seconds_bucket\{exporter="local",le="0.5"\} 1 # \{trace_id="4bf92f3577b34da6"\} 0.3 [0-9.]+$`).MatchString(body), body)
+	assert.Check(t, regexp.MustCompile(`(?m)^exemplar_test_export_seconds_bucket\{exporter="local",le="0.25"\} 0$`).MatchString(body), body)
+	assert.Check(t, regexp.MustCompile(`(?m)^exemplar_test_export_seconds_count\{exporter="local"\} 1$`).MatchString(body), body)
+	assert.Check(t, regexp.MustCompile(`# EOF\n$`).MatchString(body))
+
+	ct, body = get("text/plain")
+	assert.Check(t, is.Contains(ct, "text/plain"))
+	assert.Check(t, !regexp.MustCompile(`trace_id`).MatchString(body))
+}
@@ -0,0 +1,229 @@
+package exemplar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+const openMetricsType = "application/openmetrics-text"
+
+// Handler returns a handler that serves the metrics of h with their
+// exemplars in the OpenMetrics format to the scrapers accepting it. Other
+// requests are passed to h. h has to serve the Prometheus protobuf format
+// when it is asked for, like the handler of the Prometheus registry.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsOpenMetrics(r.Header) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		families, err := gather(h, r)
+		if err != nil {
+			http.Error(w, "An error has occurred:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		if err := writeOpenMetrics(&buf, families); err != nil {
+			http.Error(w, "An error has occurred:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", openMetricsType+"; version=1.0.0; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	})
+}
+
+func acceptsOpenMetrics(h http.Header) bool {
+	for _, accept := range strings.Split(h.Get("Accept"), ",") {
+		t, params, err := mime.ParseMediaType(accept)
+		if err == nil && t == openMetricsType && params["q"] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// gather asks h for its metrics in the Prometheus protobuf format
+func gather(h http.Handler, r *http.Request) ([]*dto.MetricFamily, error) {
+	req := r.WithContext(r.Context())
+	req.Header = http.Header{"Accept": []string{string(expfmt.FmtProtoDelim)}}
+	rec := &responseRecorder{header: http.Header{}, code: http.StatusOK}
+	h.ServeHTTP(rec, req)
+	if rec.code != http.StatusOK {
+		return nil, fmt.Errorf("failed to gather metrics: %s", strings.TrimSpace(rec.body.String()))
+	}
+	if f := expfmt.ResponseFormat(rec.header); f != expfmt.FmtProtoDelim {
+		return nil, fmt.Errorf("unexpected format of the metrics: %s", rec.header.Get("Content-Type"))
+	}
+	dec := expfmt.NewDecoder(&rec.body, expfmt.FmtProtoDelim)
+	var families []*dto.MetricFamily
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				return families, nil
+			}
+			return nil, err
+		}
+		families = append(families, mf)
+	}
+}
+
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	return r.body.Write(p)
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.code = code
+}
+
+// writeOpenMetrics writes families in the OpenMetrics text format with the
+// exemplars of their counters and histogram buckets
+func writeOpenMetrics(out io.Writer, families []*dto.MetricFamily) error {
+	w := bufio.NewWriter(out)
+	for _, mf := range families {
+		name := mf.GetName()
+		typ := "unknown"
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			// the samples of counters are named after the family with a
+			// _total suffix
+			name = strings.TrimSuffix(name, "_total")
+			typ = "counter"
+		case dto.MetricType_GAUGE:
+			typ = "gauge"
+		case dto.MetricType_SUMMARY:
+			typ = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typ = "histogram"
+		}
+		if mf.Help != nil {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, escaper.Replace(mf.GetHelp()))
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+
+		for _, m := range mf.Metric {
+			key := seriesKey(mf.GetName(), labelValues(m))
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				writeSample(w, name+"_total", m, "", "", m.GetCounter().GetValue())
+				writeExemplar(w, key, math.Inf(-1), math.Inf(1))
+			case dto.MetricType_GAUGE:
+				writeSample(w, name, m, "", "", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				writeSample(w, name, m, "", "", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					writeSample(w, name, m, "quantile", formatFloat(q.GetQuantile()), q.GetValue())
+					w.WriteString("\n")
+				}
+				writeSample(w, name+"_sum", m, "", "", s.GetSampleSum())
+				w.WriteString("\n")
+				writeSample(w, name+"_count", m, "", "", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				prev := math.Inf(-1)
+				for _, b := range h.Bucket {
+					writeSample(w, name+"_bucket", m, "le", formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+					writeExemplar(w, key, prev, b.GetUpperBound())
+					w.WriteString("\n")
+					prev = b.GetUpperBound()
+				}
+				if !math.IsInf(prev, 1) {
+					writeSample(w, name+"_bucket", m, "le", "+Inf", float64(h.GetSampleCount()))
+					writeExemplar(w, key, prev, math.Inf(1))
+					w.WriteString("\n")
+				}
+				writeSample(w, name+"_sum", m, "", "", h.GetSampleSum())
+				w.WriteString("\n")
+				writeSample(w, name+"_count", m, "", "", float64(h.GetSampleCount()))
+			}
+			w.WriteString("\n")
+		}
+	}
+	w.WriteString("# EOF\n")
+	return w.Flush()
+}
+
+// labelValues returns the label values of m in the order of their names,
+// like the values passed to Observe
+func labelValues(m *dto.Metric) []string {
+	values := make([]string, 0, len(m.Label))
+	for _, l := range m.Label {
+		values = append(values, l.GetValue())
+	}
+	return values
+}
+
+// writeSample writes a sample of m without the line break, with the
+// additional label extraName if it is set
+func writeSample(w *bufio.Writer, name string, m *dto.Metric, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(m.Label) > 0 || extraName != "" {
+		w.WriteString("{")
+		for i, l := range m.Label {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l.GetName(), escaper.Replace(l.GetValue()))
+		}
+		if extraName != "" {
+			if len(m.Label) > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, escaper.Replace(extraValue))
+		}
+		w.WriteString("}")
+	}
+	w.WriteString(" " + formatFloat(value))
+	if m.TimestampMs != nil {
+		w.WriteString(" " + strconv.FormatFloat(float64(m.GetTimestampMs())/1000, 'f', -1, 64))
+	}
+}
+
+// writeExemplar writes the newest exemplar of the series with key with a
+// value in (min, max], if there is one
+func writeExemplar(w *bufio.Writer, key string, min, max float64) {
+	e, ok := latest(key, min, max)
+	if !ok {
+		return
+	}
+	ts := float64(e.timestamp.UnixNano()/int64(1e6)) / 1000
+	fmt.Fprintf(w, " # {trace_id=\"%s\"} %s %s", escaper.Replace(e.traceID), formatFloat(e.value), strconv.FormatFloat(ts, 'f', -1, 64))
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// escaper escapes help texts and label values
+var escaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
@@ -0,0 +1,112 @@
+package containerimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/util/attestation"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// hasAttestations reports whether md contains attestations of the result
+func hasAttestations(md map[string][]byte) bool {
+	for k := range md {
+		if k == exptypes.ExporterProvenanceKey || k == exptypes.ExporterSBOMKey || strings.HasPrefix(k, exptypes.ExporterSBOMKey+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAttestations writes an attestation manifest for every image manifest
+// that has attestations in md and returns their descriptors. ids are the
+// keys of the platforms of the manifests and name the subject name of the
+// statements.
+func (w *layoutWriter) writeAttestations(manifests []ocispec.Descriptor, ids []string, md map[string][]byte, name string) ([]ocispec.Descriptor, error) {
+	var out []ocispec.Descriptor
+	for i, target := range manifests {
+		sbomKey := exptypes.ExporterSBOMKey
+		if ids[i] != "" {
+			sbomKey = fmt.Sprintf("%s/%s", sbomKey, ids[i])
+		}
+		var statements []ocispec.Descriptor
+		for _, p := range []struct {
+			key           string
+			predicateType string
+		}{
+			{exptypes.ExporterProvenanceKey, attestation.PredicateTypeProvenance},
+			{sbomKey, attestation.PredicateTypeSPDX},
+		} {
+			predicate, ok := md[p.key]
+			if !ok {
+				continue
+			}
+			dt, err := attestation.NewStatement(p.predicateType, predicate, name, target.Digest)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to marshal attestation")
+			}
+			desc, err := w.writeBlob(attestation.MediaTypeInToto, dt)
+			if err != nil {
+				return nil, err
+			}
+			desc.Annotations = map[string]string{
+				attestation.AnnotationPredicateType: p.predicateType,
+			}
+			statements = append(statements, desc)
+		}
+		if len(statements) == 0 {
+			continue
+		}
+		desc, err := w.writeAttestationManifest(target, statements)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, desc)
+	}
+	return out, nil
+}
+
+// writeAttestationManifest writes the manifest of the statements about
+// target. The manifest has an unknown platform so that it is never pulled
+// as an image.
+func (w *layoutWriter) writeAttestationManifest(target ocispec.Descriptor, statements []ocispec.Descriptor) (ocispec.Descriptor, error) {
+	img := ocispec.Image{
+		Architecture: "unknown",
+		OS:           "unknown",
+		RootFS:       ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{}},
+	}
+	for _, st := range statements {
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, st.Digest)
+	}
+	config, err := json.Marshal(img)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal attestation config")
+	}
+	mfst := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Layers:    statements,
+	}
+	mfst.Config, err = w.writeBlob(ocispec.MediaTypeImageConfig, config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	dt, err := json.Marshal(mfst)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal attestation manifest")
+	}
+	desc, err := w.writeBlob(ocispec.MediaTypeImageManifest, dt)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc.Platform = &ocispec.Platform{Architecture: "unknown", OS: "unknown"}
+	desc.Annotations = map[string]string{
+		attestation.AnnotationReferenceType:   attestation.ReferenceTypeAttestation,
+		attestation.AnnotationReferenceDigest: target.Digest.String(),
+	}
+	return desc, nil
+}
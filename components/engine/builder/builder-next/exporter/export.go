@@ -2,17 +2,22 @@ package containerimage
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"strings"
 
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/distribution/manifest/schema2"
 	distref "github.com/docker/distribution/reference"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
 	"github.com/docker/docker/reference"
+	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/exporter"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -31,6 +36,7 @@ type Opt struct {
 	ImageStore     image.Store
 	ReferenceStore reference.Store
 	Differ         Differ
+	LayerStore     layer.Store
 }
 
 type imageExporter struct {
@@ -79,25 +85,24 @@ func (e *imageExporterInstance) Name() string {
 
 func (e *imageExporterInstance) Export(ctx context.Context, inp exporter.Source) (map[string]string, error) {
 
-	if len(inp.Refs) > 1 {
-		return nil, fmt.Errorf("exporting multiple references to image store is currently unsupported")
-	}
-
 	ref := inp.Ref
 	if ref != nil && len(inp.Refs) == 1 {
-		return nil, fmt.Errorf("invalid exporter input: Ref and Refs are mutually exclusive")
-	}
-
-	// only one loop
-	for _, v := range inp.Refs {
-		ref = v
+		// the solver sets Ref to the ref for the default platform
+		for _, v := range inp.Refs {
+			if v != ref {
+				return nil, fmt.Errorf("invalid exporter input: Ref and Refs are mutually exclusive")
+			}
+		}
 	}
 
-	var config []byte
-	switch len(inp.Refs) {
-	case 0:
-		config = inp.Metadata[exptypes.ExporterImageConfigKey]
-	case 1:
+	var images []*exportedImage
+	if len(inp.Refs) == 0 {
+		img, err := e.exportImage(ctx, inp, ref, "", false)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	} else {
 		platformsBytes, ok := inp.Metadata[exptypes.ExporterPlatformsKey]
 		if !ok {
 			return nil, fmt.Errorf("cannot export image, missing platforms mapping")
@@ -109,12 +114,123 @@ func (e *imageExporterInstance) Export(ctx context.Context, inp exporter.Source)
 		if len(p.Platforms) != len(inp.Refs) {
 			return nil, errors.Errorf("number of platforms does not match references %d %d", len(p.Platforms), len(inp.Refs))
 		}
-		config = inp.Metadata[fmt.Sprintf("%s/%s", exptypes.ExporterImageConfigKey, p.Platforms[0].ID)]
+		for _, pl := range p.Platforms {
+			r, ok := inp.Refs[pl.ID]
+			if !ok {
+				return nil, errors.Errorf("failed to find ref for ID %s", pl.ID)
+			}
+			img, err := e.exportImage(ctx, inp, r, pl.ID, len(p.Platforms) > 1)
+			if err != nil {
+				return nil, err
+			}
+			img.platform = pl.Platform
+			images = append(images, img)
+		}
 	}
 
+	for _, k := range []string{exptypes.ExporterIndexAnnotationsKey, exptypes.ExporterManifestAnnotationsKey} {
+		if _, ok := inp.Metadata[k]; ok {
+			logrus.Warnf("image exporter: ignoring %s, the image store has no index or manifests to annotate", k)
+		}
+	}
+
+	// the image store has no manifest lists, the image for the platform of
+	// the daemon is the one that gets the target names
+	img := images[0]
+	if len(images) > 1 {
+		match := platforms.NewMatcher(platforms.DefaultSpec())
+		for _, i := range images {
+			if match.Match(i.platform) {
+				img = i
+				break
+			}
+		}
+	}
+
+	if e.opt.ReferenceStore != nil {
+		for _, targetName := range e.targetNames {
+			tagDone := oneOffProgress(ctx, "naming to "+targetName.String())
+
+			if err := e.opt.ReferenceStore.AddTag(targetName, digest.Digest(img.id), true); err != nil {
+				return nil, tagDone(err)
+			}
+			tagDone(nil)
+		}
+	}
+
+	resp := map[string]string{
+		exptypes.ExporterImageDigestKey: img.id.String(),
+	}
+	desc, err := json.Marshal(ocispec.Descriptor{
+		MediaType: schema2.MediaTypeImageConfig,
+		Digest:    digest.Digest(img.id),
+		Size:      img.size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp[exptypes.ExporterImageDescriptorKey] = base64.StdEncoding.EncodeToString(desc)
+	if len(e.targetNames) > 0 {
+		names := make([]string, len(e.targetNames))
+		for i, n := range e.targetNames {
+			names[i] = n.String()
+		}
+		resp[exptypes.ExporterImageNameKey] = strings.Join(names, ",")
+	}
+	if len(images) > 1 {
+		for _, i := range images {
+			resp["containerimage.digest/"+i.platformID] = i.id.String()
+		}
+	}
+	if img.included != nil {
+		for k, v := range map[string][]digest.Digest{
+			"containerimage.layers.included": img.included,
+			"containerimage.layers.excluded": img.excluded,
+		} {
+			dt, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			resp[k] = string(dt)
+		}
+	}
+	return resp, nil
+}
+
+// exportedImage is an image that was written to the image store for one
+// platform of the result
+type exportedImage struct {
+	id                 image.ID
+	size               int64
+	platformID         string
+	platform           ocispec.Platform
+	included, excluded []digest.Digest
+}
+
+// exportImage writes the image of ref to the image store. platformID selects
+// the per-platform metadata if the result has Refs and is empty otherwise.
+// multi names the progress of the image after its platform.
+func (e *imageExporterInstance) exportImage(ctx context.Context, inp exporter.Source, ref cache.ImmutableRef, platformID string, multi bool) (*exportedImage, error) {
+	metaKey := func(k string) string {
+		if platformID == "" {
+			return k
+		}
+		return fmt.Sprintf("%s/%s", k, platformID)
+	}
+	progressID := func(id string) string {
+		if !multi {
+			return id
+		}
+		return fmt.Sprintf("%s for %s", id, platformID)
+	}
+
+	config := inp.Metadata[metaKey(exptypes.ExporterImageConfigKey)]
+	annotations := inp.Metadata[metaKey(exptypes.ExporterAnnotationsKey)]
+	inlineCache := inp.Metadata[metaKey(exptypes.ExporterInlineCache)]
+
 	var diffs []digest.Digest
 	if ref != nil {
-		layersDone := oneOffProgress(ctx, "exporting layers")
+		layersDone := oneOffProgress(ctx, progressID("exporting layers"))
 
 		if err := ref.Finalize(ctx, true); err != nil {
 			return nil, err
@@ -148,32 +264,104 @@ func (e *imageExporterInstance) Export(ctx context.Context, inp exporter.Source)
 
 	diffs, history = normalizeLayersAndHistory(diffs, history, ref)
 
+	var included, excluded []digest.Digest
+	if dt, ok := inp.Metadata[exptypes.ExporterLayerSelectorKey]; ok && len(diffs) > 0 {
+		var selector map[string]string
+		if err := json.Unmarshal(dt, &selector); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse layer selector")
+		}
+		include := make([]bool, len(diffs))
+		included, excluded = []digest.Digest{}, []digest.Digest{}
+		for i, md := range getRefMetadata(ref, len(diffs)) {
+			include[i] = matchLabels(md.labels, selector)
+			if include[i] {
+				included = append(included, diffs[i])
+			} else {
+				excluded = append(excluded, diffs[i])
+			}
+		}
+		selectDone := oneOffProgress(ctx, progressID("selecting layers"))
+		var release func()
+		var err error
+		diffs, history, release, err = selectLayers(e.opt.LayerStore, diffs, history, include)
+		if err != nil {
+			return nil, selectDone(err)
+		}
+		defer release()
+		selectDone(nil)
+	}
+
+	if squashTo, ok := inp.Metadata[exptypes.ExporterSquashBaseToKey]; ok && len(diffs) > 0 {
+		squashDone := oneOffProgress(ctx, progressID("squashing base layers"))
+		var release func()
+		var err error
+		diffs, history, release, err = squashBase(e.opt.LayerStore, diffs, history, digest.Digest(squashTo))
+		if err != nil {
+			return nil, squashDone(err)
+		}
+		defer release()
+		squashDone(nil)
+	}
+
+	if _, ok := inp.Metadata[exptypes.ExporterDeterministicKey]; ok && len(diffs) > 0 {
+		normalizeDone := oneOffProgress(ctx, progressID("normalizing whiteouts"))
+		var release func()
+		var err error
+		diffs, release, err = normalizeWhiteouts(e.opt.LayerStore, diffs)
+		if err != nil {
+			return nil, normalizeDone(err)
+		}
+		defer release()
+		normalizeDone(nil)
+	}
+
 	config, err = patchImageConfig(config, diffs, history)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(annotations) > 0 {
+		var labels map[string]string
+		if err := json.Unmarshal(annotations, &labels); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse annotations")
+		}
+		config, err = addImageLabels(config, labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(inlineCache) > 0 {
+		config, err = addInlineCache(config, inlineCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	configDigest := digest.FromBytes(config)
 
-	configDone := oneOffProgress(ctx, fmt.Sprintf("writing image %s", configDigest))
+	configDone := oneOffProgress(ctx, progressID(fmt.Sprintf("writing image %s", configDigest)))
 	id, err := e.opt.ImageStore.Create(config)
 	if err != nil {
 		return nil, configDone(err)
 	}
 	configDone(nil)
 
-	if e.opt.ReferenceStore != nil {
-		for _, targetName := range e.targetNames {
-			tagDone := oneOffProgress(ctx, "naming to "+targetName.String())
+	return &exportedImage{
+		id:         id,
+		size:       int64(len(config)),
+		platformID: platformID,
+		included:   included,
+		excluded:   excluded,
+	}, nil
+}
 
-			if err := e.opt.ReferenceStore.AddTag(targetName, digest.Digest(id), true); err != nil {
-				return nil, tagDone(err)
-			}
-			tagDone(nil)
+// matchLabels reports whether labels contain all entries of selector
+func matchLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
 		}
 	}
-
-	return map[string]string{
-		"containerimage.digest": id.String(),
-	}, nil
+	return true
 }
@@ -0,0 +1,69 @@
+package containerimage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/docker/docker/image"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/exporter"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+// memoryImageStore keeps the configs of the created images
+type memoryImageStore struct {
+	image.Store
+	configs map[image.ID][]byte
+}
+
+func (s *memoryImageStore) Create(config []byte) (image.ID, error) {
+	id := image.ID(digest.FromBytes(config))
+	s.configs[id] = config
+	return id, nil
+}
+
+func TestExportMultiPlatform(t *testing.T) {
+	store := &memoryImageStore{configs: map[image.ID][]byte{}}
+	e, err := New(Opt{ImageStore: store})
+	assert.NilError(t, err)
+	inst, err := e.Resolve(context.Background(), nil)
+	assert.NilError(t, err)
+
+	platforms := []ocispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	}
+	src := exporter.Source{
+		Refs:     map[string]cache.ImmutableRef{},
+		Metadata: map[string][]byte{},
+	}
+	var p exptypes.Platforms
+	for _, pl := range platforms {
+		id := pl.OS + "/" + pl.Architecture
+		// the refs of the platforms are empty results
+		src.Refs[id] = nil
+		p.Platforms = append(p.Platforms, exptypes.Platform{ID: id, Platform: pl})
+		config, err := json.Marshal(ocispec.Image{OS: pl.OS, Architecture: pl.Architecture})
+		assert.NilError(t, err)
+		src.Metadata[exptypes.ExporterImageConfigKey+"/"+id] = config
+	}
+	dt, err := json.Marshal(p)
+	assert.NilError(t, err)
+	src.Metadata[exptypes.ExporterPlatformsKey] = dt
+
+	resp, err := inst.Export(context.Background(), src)
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(store.configs, 2))
+	for _, pl := range platforms {
+		id, ok := resp["containerimage.digest/"+pl.OS+"/"+pl.Architecture]
+		assert.Assert(t, ok, "no image for %s", pl.Architecture)
+		var img ocispec.Image
+		assert.NilError(t, json.Unmarshal(store.configs[image.ID(id)], &img))
+		assert.Check(t, is.Equal(pl.Architecture, img.Architecture))
+	}
+}
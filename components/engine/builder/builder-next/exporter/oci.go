@@ -0,0 +1,544 @@
+package containerimage
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	distref "github.com/docker/distribution/reference"
+	"github.com/docker/docker/layer"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/exporter"
+	"github.com/moby/buildkit/exporter/containerimage/exptypes"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/filesync"
+	"github.com/moby/buildkit/util/compression"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// annotationImageName is the annotation containerd uses for the full name of
+// an image in an index
+const annotationImageName = "io.containerd.image.name"
+
+const (
+	// keyCompression selects the compression of the layers and
+	// keyCompressionLevel its level. They take precedence over the
+	// compression of the exporter request.
+	keyCompression      = "compression"
+	keyCompressionLevel = "compression-level"
+)
+
+// OCIOpt defines a struct for creating a new OCI layout exporter
+type OCIOpt struct {
+	SessionManager *session.Manager
+	Differ         Differ
+	LayerStore     layer.Store
+}
+
+type ociExporter struct {
+	opt OCIOpt
+}
+
+// NewOCI creates a new exporter that sends the result to the client as an
+// OCI image layout tarball
+func NewOCI(opt OCIOpt) (exporter.Exporter, error) {
+	return &ociExporter{opt: opt}, nil
+}
+
+func (e *ociExporter) Resolve(ctx context.Context, opt map[string]string) (exporter.ExporterInstance, error) {
+	i := &ociExporterInstance{ociExporter: e}
+	for k, v := range opt {
+		switch k {
+		case keyImageName:
+			ref, err := distref.ParseNormalizedNamed(v)
+			if err != nil {
+				return nil, err
+			}
+			i.name = distref.TagNameOnly(ref)
+		case keyCompression:
+			c, err := compression.Parse(v)
+			if err != nil {
+				return nil, err
+			}
+			i.compression = c
+		case keyCompressionLevel:
+			l, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s %q", keyCompressionLevel, v)
+			}
+			i.level = &l
+		default:
+			logrus.Warnf("oci exporter: unknown option %s", k)
+		}
+	}
+	return i, nil
+}
+
+type ociExporterInstance struct {
+	*ociExporter
+	name        distref.Named
+	compression compression.Type
+	level       *int
+}
+
+// layerCompression returns the compression of the layers of the export of
+// md, set by the exporter attrs or the exporter request
+func (e *ociExporterInstance) layerCompression(md map[string][]byte) (compression.Type, int, error) {
+	c := e.compression
+	if c == "" {
+		var err error
+		if c, err = compression.Parse(string(md[exptypes.ExporterCompressionKey])); err != nil {
+			return "", 0, err
+		}
+	}
+	var level int
+	if e.level != nil {
+		level = *e.level
+	} else if dt, ok := md[exptypes.ExporterCompressionLevelKey]; ok {
+		l, err := strconv.Atoi(string(dt))
+		if err != nil {
+			return "", 0, errors.Wrapf(err, "invalid compression level %q", dt)
+		}
+		level = l
+	}
+	if err := c.Validate(level); err != nil {
+		return "", 0, err
+	}
+	return c, level, nil
+}
+
+func (e *ociExporterInstance) Name() string {
+	return "exporting to oci image format"
+}
+
+// Export writes an image layout with a manifest for every platform of the
+// result and streams it to the client. The returned containerimage.digest is
+// the digest of the manifest, or of the index for multi-platform results and
+// results with attestations, which are added to the index as attestation
+// manifests.
+func (e *ociExporterInstance) Export(ctx context.Context, inp exporter.Source) (map[string]string, error) {
+	caller, err := e.getCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "buildkit-oci")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	c, level, err := e.layerCompression(inp.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &layoutWriter{dir: dir, ls: e.opt.LayerStore, compression: c, level: level}
+
+	var manifests []ocispec.Descriptor
+	var ids []string
+	if len(inp.Refs) == 0 {
+		desc, err := e.writeManifest(ctx, w, inp.Ref, inp.Metadata, "")
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, desc)
+		ids = append(ids, "")
+	} else {
+		platformsBytes, ok := inp.Metadata[exptypes.ExporterPlatformsKey]
+		if !ok {
+			return nil, errors.Errorf("cannot export image, missing platforms mapping")
+		}
+		var p exptypes.Platforms
+		if err := json.Unmarshal(platformsBytes, &p); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse platforms passed to exporter")
+		}
+		if len(p.Platforms) != len(inp.Refs) {
+			return nil, errors.Errorf("number of platforms does not match references %d %d", len(p.Platforms), len(inp.Refs))
+		}
+		for _, p := range p.Platforms {
+			ref, ok := inp.Refs[p.ID]
+			if !ok {
+				return nil, errors.Errorf("failed to find ref for ID %s", p.ID)
+			}
+			desc, err := e.writeManifest(ctx, w, ref, inp.Metadata, p.ID)
+			if err != nil {
+				return nil, err
+			}
+			platform := p.Platform
+			desc.Platform = &platform
+			manifests = append(manifests, desc)
+			ids = append(ids, p.ID)
+		}
+	}
+
+	if hasAttestations(inp.Metadata) {
+		var name string
+		if e.name != nil {
+			name = e.name.String()
+		}
+		attestations, err := w.writeAttestations(manifests, ids, inp.Metadata, name)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, attestations...)
+	}
+
+	var target ocispec.Descriptor
+	if len(manifests) == 1 {
+		target = manifests[0]
+	} else {
+		idx := ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Manifests: manifests,
+		}
+		dt, err := json.Marshal(idx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal index")
+		}
+		target, err = w.writeBlob(ocispec.MediaTypeImageIndex, dt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if e.name != nil {
+		target.Annotations = map[string]string{
+			annotationImageName: e.name.String(),
+		}
+		if tagged, ok := e.name.(distref.Tagged); ok {
+			target.Annotations[ocispec.AnnotationRefName] = tagged.Tag()
+		}
+	}
+
+	idx := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{target},
+	}
+	if dt, ok := inp.Metadata[exptypes.ExporterIndexAnnotationsKey]; ok {
+		if err := json.Unmarshal(dt, &idx.Annotations); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse index annotations")
+		}
+	}
+	if err := w.writeLayout(idx); err != nil {
+		return nil, err
+	}
+
+	sendDone := oneOffProgress(ctx, "sending tarball")
+	wc, err := filesync.CopyFileWriter(ctx, caller)
+	if err != nil {
+		return nil, sendDone(err)
+	}
+	if err := tarDir(wc, dir); err != nil {
+		wc.Close()
+		return nil, sendDone(err)
+	}
+	if err := wc.Close(); err != nil {
+		return nil, sendDone(err)
+	}
+	sendDone(nil)
+
+	desc, err := json.Marshal(target)
+	if err != nil {
+		return nil, err
+	}
+	resp := map[string]string{
+		exptypes.ExporterImageDigestKey:     target.Digest.String(),
+		exptypes.ExporterImageDescriptorKey: base64.StdEncoding.EncodeToString(desc),
+	}
+	if e.name != nil {
+		resp[exptypes.ExporterImageNameKey] = e.name.String()
+	}
+	return resp, nil
+}
+
+// writeManifest writes the layers, config and manifest of ref to the layout.
+// id is the key of the ref in the platforms mapping, or empty for a result
+// without platforms.
+func (e *ociExporterInstance) writeManifest(ctx context.Context, w *layoutWriter, ref cache.ImmutableRef, md map[string][]byte, id string) (ocispec.Descriptor, error) {
+	key := func(k string) string {
+		if id == "" {
+			return k
+		}
+		return fmt.Sprintf("%s/%s", k, id)
+	}
+	config := md[key(exptypes.ExporterImageConfigKey)]
+	annotations := md[key(exptypes.ExporterAnnotationsKey)]
+	inlineCache := md[key(exptypes.ExporterInlineCache)]
+
+	var diffs []digest.Digest
+	if ref != nil {
+		layersDone := oneOffProgress(ctx, "exporting layers")
+
+		if err := ref.Finalize(ctx, true); err != nil {
+			return ocispec.Descriptor{}, layersDone(err)
+		}
+
+		diffIDs, err := e.opt.Differ.EnsureLayer(ctx, ref.ID())
+		if err != nil {
+			return ocispec.Descriptor{}, layersDone(err)
+		}
+
+		diffs = make([]digest.Digest, len(diffIDs))
+		for i := range diffIDs {
+			diffs[i] = digest.Digest(diffIDs[i])
+		}
+
+		layersDone(nil)
+	}
+
+	if len(config) == 0 {
+		var err error
+		config, err = emptyImageConfig()
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	history, err := parseHistoryFromConfig(config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	diffs, history = normalizeLayersAndHistory(diffs, history, ref)
+
+	config, err = patchImageConfig(config, diffs, history)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	if len(annotations) > 0 {
+		var labels map[string]string
+		if err := json.Unmarshal(annotations, &labels); err != nil {
+			return ocispec.Descriptor{}, errors.Wrapf(err, "failed to parse annotations")
+		}
+		config, err = addImageLabels(config, labels)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	if len(inlineCache) > 0 {
+		config, err = addInlineCache(config, inlineCache)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	mfst := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+	}
+
+	blobsDone := oneOffProgress(ctx, "writing layer blobs")
+	for i := range diffs {
+		desc, err := w.writeLayer(diffs[:i+1])
+		if err != nil {
+			return ocispec.Descriptor{}, blobsDone(err)
+		}
+		mfst.Layers = append(mfst.Layers, desc)
+	}
+	blobsDone(nil)
+
+	mfst.Config, err = w.writeBlob(ocispec.MediaTypeImageConfig, config)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	if dt, ok := md[exptypes.ExporterManifestAnnotationsKey]; ok {
+		if err := json.Unmarshal(dt, &mfst.Annotations); err != nil {
+			return ocispec.Descriptor{}, errors.Wrapf(err, "failed to parse manifest annotations")
+		}
+	}
+
+	dt, err := json.Marshal(mfst)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to marshal manifest")
+	}
+
+	return w.writeBlob(ocispec.MediaTypeImageManifest, dt)
+}
+
+func (e *ociExporterInstance) getCaller(ctx context.Context) (session.Caller, error) {
+	sessionID := session.FromContext(ctx)
+	if sessionID == "" {
+		return nil, errors.New("could not send oci tarball without session")
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return e.opt.SessionManager.Get(timeoutCtx, sessionID)
+}
+
+// layoutWriter writes the blobs of an OCI image layout to dir. Layers are
+// compressed with compression at level.
+type layoutWriter struct {
+	dir         string
+	ls          layer.Store
+	compression compression.Type
+	level       int
+}
+
+func (w *layoutWriter) blobPath(dgst digest.Digest) string {
+	return filepath.Join(w.dir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+func (w *layoutWriter) writeBlob(mediaType string, dt []byte) (ocispec.Descriptor, error) {
+	dgst := digest.FromBytes(dt)
+	p := w.blobPath(dgst)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return ocispec.Descriptor{}, errors.WithStack(err)
+	}
+	if err := ioutil.WriteFile(p, dt, 0644); err != nil {
+		return ocispec.Descriptor{}, errors.WithStack(err)
+	}
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(dt)),
+	}, nil
+}
+
+// writeLayer writes the compressed diff of the top layer of the chain of
+// diffs to the layout
+func (w *layoutWriter) writeLayer(diffs []digest.Digest) (ocispec.Descriptor, error) {
+	if w.ls == nil {
+		return ocispec.Descriptor{}, errors.New("exporting layers is not supported without a layer store")
+	}
+	diffIDs := make([]layer.DiffID, len(diffs))
+	for i, d := range diffs {
+		diffIDs[i] = layer.DiffID(d)
+	}
+	l, err := w.ls.Get(layer.CreateChainID(diffIDs))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer layer.ReleaseAndLog(w.ls, l)
+
+	rc, err := l.TarStream()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Join(w.dir, "blobs", digest.Canonical.String()), 0755); err != nil {
+		return ocispec.Descriptor{}, errors.WithStack(err)
+	}
+	f, err := ioutil.TempFile(filepath.Join(w.dir, "blobs"), "layer")
+	if err != nil {
+		return ocispec.Descriptor{}, errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+
+	dgstr := digest.Canonical.Digester()
+	cw := &countWriter{w: io.MultiWriter(f, dgstr.Hash())}
+	gw, err := w.compression.Writer(cw, w.level)
+	if err != nil {
+		f.Close()
+		return ocispec.Descriptor{}, err
+	}
+	if _, err := io.Copy(gw, rc); err != nil {
+		f.Close()
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to compress layer")
+	}
+	if err := gw.Close(); err != nil {
+		f.Close()
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to compress layer")
+	}
+	if err := f.Close(); err != nil {
+		return ocispec.Descriptor{}, errors.WithStack(err)
+	}
+
+	dgst := dgstr.Digest()
+	if err := os.Rename(f.Name(), w.blobPath(dgst)); err != nil {
+		return ocispec.Descriptor{}, errors.WithStack(err)
+	}
+	return ocispec.Descriptor{
+		MediaType: w.compression.MediaType(true),
+		Digest:    dgst,
+		Size:      cw.n,
+	}, nil
+}
+
+func (w *layoutWriter) writeLayout(idx ocispec.Index) error {
+	dt, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal image layout")
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.dir, ocispec.ImageLayoutFile), dt, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	dt, err = json.Marshal(idx)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal index")
+	}
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(w.dir, "index.json"), dt, 0644))
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// tarDir writes the files of dir to w as a tarball with paths relative to dir
+// and without timestamps
+func tarDir(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.ModTime = time.Unix(0, 0)
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}); err != nil {
+		return errors.Wrap(err, "failed to write oci tarball")
+	}
+	return errors.WithStack(tw.Close())
+}
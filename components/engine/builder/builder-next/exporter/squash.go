@@ -0,0 +1,172 @@
+package containerimage
+
+import (
+	"github.com/docker/docker/layer"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// squashBase squashes the layers up to and including the layer with diff ID
+// squashTo into a single layer and registers the layers above it on top of
+// the squashed layer. The returned function releases the registered layers.
+func squashBase(ls layer.Store, diffs []digest.Digest, history []ocispec.History, squashTo digest.Digest) ([]digest.Digest, []ocispec.History, func(), error) {
+	if ls == nil {
+		return nil, nil, nil, errors.New("squashing layers is not supported without a layer store")
+	}
+	index := -1
+	for i, d := range diffs {
+		if d == squashTo {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return nil, nil, nil, errors.Errorf("layer %s to squash to not found in image", squashTo)
+	}
+
+	var registered []layer.Layer
+	release := func() {
+		for _, l := range registered {
+			layer.ReleaseAndLog(ls, l)
+		}
+	}
+
+	diffIDs := make([]layer.DiffID, len(diffs))
+	for i, d := range diffs {
+		diffIDs[i] = layer.DiffID(d)
+	}
+
+	base, err := ls.Get(layer.CreateChainID(diffIDs[:index+1]))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer layer.ReleaseAndLog(ls, base)
+
+	parent, err := registerTarStream(ls, base, "", "")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	registered = append(registered, parent)
+	newDiffs := []digest.Digest{digest.Digest(parent.DiffID())}
+
+	for i := index + 1; i < len(diffIDs); i++ {
+		l, err := ls.Get(layer.CreateChainID(diffIDs[:i+1]))
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		nl, err := registerTarStream(ls, l, layer.CreateChainID(diffIDs[:i]), parent.ChainID())
+		layer.ReleaseAndLog(ls, l)
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		registered = append(registered, nl)
+		newDiffs = append(newDiffs, digest.Digest(nl.DiffID()))
+		parent = nl
+	}
+
+	// keep the history of the squashed layers but only the last one of them
+	// is accounted for the squashed layer
+	newHistory := make([]ocispec.History, 0, len(history))
+	var layerIndex int
+	for _, h := range history {
+		if !h.EmptyLayer {
+			if layerIndex < index {
+				h.EmptyLayer = true
+			}
+			layerIndex++
+		}
+		newHistory = append(newHistory, h)
+	}
+
+	return newDiffs, newHistory, release, nil
+}
+
+// selectLayers keeps the layers marked in include and merges every other
+// layer into the closest kept layer above it. Layers above the last kept
+// layer are merged into it. The returned function releases the registered
+// layers.
+func selectLayers(ls layer.Store, diffs []digest.Digest, history []ocispec.History, include []bool) ([]digest.Digest, []ocispec.History, func(), error) {
+	if ls == nil {
+		return nil, nil, nil, errors.New("selecting layers is not supported without a layer store")
+	}
+	var ends []int
+	for i, ok := range include {
+		if ok {
+			ends = append(ends, i)
+		}
+	}
+	if len(ends) == 0 {
+		return nil, nil, nil, errors.New("no layer of the image matches the layer selector")
+	}
+	ends[len(ends)-1] = len(diffs) - 1
+
+	var registered []layer.Layer
+	release := func() {
+		for _, l := range registered {
+			layer.ReleaseAndLog(ls, l)
+		}
+	}
+
+	diffIDs := make([]layer.DiffID, len(diffs))
+	for i, d := range diffs {
+		diffIDs[i] = layer.DiffID(d)
+	}
+
+	var from, parent layer.ChainID
+	newDiffs := make([]digest.Digest, 0, len(ends))
+	for _, end := range ends {
+		l, err := ls.Get(layer.CreateChainID(diffIDs[:end+1]))
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		nl, err := registerTarStream(ls, l, from, parent)
+		layer.ReleaseAndLog(ls, l)
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		registered = append(registered, nl)
+		newDiffs = append(newDiffs, digest.Digest(nl.DiffID()))
+		from = layer.CreateChainID(diffIDs[:end+1])
+		parent = nl.ChainID()
+	}
+
+	// only the last layer of every merged range is accounted for in the
+	// history
+	isEnd := make(map[int]bool, len(ends))
+	for _, end := range ends {
+		isEnd[end] = true
+	}
+	newHistory := make([]ocispec.History, 0, len(history))
+	var layerIndex int
+	for _, h := range history {
+		if !h.EmptyLayer {
+			if !isEnd[layerIndex] {
+				h.EmptyLayer = true
+			}
+			layerIndex++
+		}
+		newHistory = append(newHistory, h)
+	}
+
+	return newDiffs, newHistory, release, nil
+}
+
+// registerTarStream registers the changes of l since the from chain as a new
+// layer on top of parent
+func registerTarStream(ls layer.Store, l layer.Layer, from, parent layer.ChainID) (layer.Layer, error) {
+	ts, err := l.TarStreamFrom(from)
+	if err != nil {
+		return nil, err
+	}
+	defer ts.Close()
+	nl, err := ls.Register(ts, parent)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to register squashed layer")
+	}
+	return nl, nil
+}
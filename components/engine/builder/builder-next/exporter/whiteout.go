@@ -0,0 +1,162 @@
+package containerimage
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/layer"
+	"github.com/docker/docker/pkg/archive"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// normalizeWhiteouts registers the layers of diffs again with their
+// whiteouts in a canonical form, so deletion layers don't depend on how the
+// snapshotter of the worker represented them. The returned function releases
+// the registered layers.
+func normalizeWhiteouts(ls layer.Store, diffs []digest.Digest) ([]digest.Digest, func(), error) {
+	if ls == nil {
+		return nil, nil, errors.New("normalizing layers is not supported without a layer store")
+	}
+
+	var registered []layer.Layer
+	release := func() {
+		for _, l := range registered {
+			layer.ReleaseAndLog(ls, l)
+		}
+	}
+
+	diffIDs := make([]layer.DiffID, len(diffs))
+	for i, d := range diffs {
+		diffIDs[i] = layer.DiffID(d)
+	}
+
+	var parent layer.ChainID
+	newDiffs := make([]digest.Digest, 0, len(diffs))
+	for i := range diffIDs {
+		l, err := ls.Get(layer.CreateChainID(diffIDs[:i+1]))
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		nl, err := registerNormalized(ls, l, parent)
+		layer.ReleaseAndLog(ls, l)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		registered = append(registered, nl)
+		newDiffs = append(newDiffs, digest.Digest(nl.DiffID()))
+		parent = nl.ChainID()
+	}
+	return newDiffs, release, nil
+}
+
+func registerNormalized(ls layer.Store, l layer.Layer, parent layer.ChainID) (layer.Layer, error) {
+	ts, err := l.TarStream()
+	if err != nil {
+		return nil, err
+	}
+	defer ts.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copyNormalizedWhiteouts(tar.NewWriter(pw), tar.NewReader(ts)))
+	}()
+	defer pr.Close()
+
+	nl, err := ls.Register(pr, parent)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to register normalized layer")
+	}
+	return nl, nil
+}
+
+// copyNormalizedWhiteouts copies a layer tar stream and writes all whiteouts
+// in the AUFS format with fixed headers. Overlay style whiteouts (0/0 char
+// devices and opaque xattrs on directories) are converted, and the opaque
+// marker of a directory always directly follows the directory entry.
+func copyNormalizedWhiteouts(tw *tar.Writer, tr *tar.Reader) error {
+	opaque := make(map[string]struct{})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(path.Clean(hdr.Name), "/")
+		base := path.Base(name)
+		dir := path.Dir(name)
+
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+			if _, ok := opaque[dir]; ok {
+				continue
+			}
+			opaque[dir] = struct{}{}
+			if err := tw.WriteHeader(whiteoutHeader(hdr.Name)); err != nil {
+				return err
+			}
+			continue
+		case strings.HasPrefix(base, archive.WhiteoutPrefix) && !strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			if err := tw.WriteHeader(whiteoutHeader(hdr.Name)); err != nil {
+				return err
+			}
+			continue
+		case hdr.Typeflag == tar.TypeChar && hdr.Devmajor == 0 && hdr.Devminor == 0:
+			if err := tw.WriteHeader(whiteoutHeader(path.Join(dir, archive.WhiteoutPrefix+base))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		isOpaque := hdr.Typeflag == tar.TypeDir && removeOpaqueXattr(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+		if isOpaque {
+			if _, ok := opaque[name]; !ok {
+				opaque[name] = struct{}{}
+				if err := tw.WriteHeader(whiteoutHeader(path.Join(name, archive.WhiteoutOpaqueDir))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// whiteoutHeader returns the header of an AUFS whiteout file. The metadata
+// of a whiteout has no meaning so it is fixed.
+func whiteoutHeader(name string) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		ModTime:  time.Unix(0, 0),
+	}
+}
+
+// removeOpaqueXattr removes the overlay opaque xattr from a directory header
+// and reports whether it was set
+func removeOpaqueXattr(hdr *tar.Header) bool {
+	var isOpaque bool
+	if v, ok := hdr.Xattrs[overlayOpaqueXattr]; ok {
+		isOpaque = v == "y"
+		delete(hdr.Xattrs, overlayOpaqueXattr)
+	}
+	if v, ok := hdr.PAXRecords["SCHILY.xattr."+overlayOpaqueXattr]; ok {
+		isOpaque = isOpaque || v == "y"
+		delete(hdr.PAXRecords, "SCHILY.xattr."+overlayOpaqueXattr)
+	}
+	return isOpaque
+}
@@ -0,0 +1,89 @@
+package containerimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"gotest.tools/assert"
+	is "gotest.tools/assert/cmp"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func layerTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		assert.NilError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(e.data))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func normalizedDigest(t *testing.T, layer []byte) digest.Digest {
+	var buf bytes.Buffer
+	assert.NilError(t, copyNormalizedWhiteouts(tar.NewWriter(&buf), tar.NewReader(bytes.NewReader(layer))))
+	return digest.FromBytes(buf.Bytes())
+}
+
+// TestNormalizeWhiteoutsAcrossSnapshotters compares a layer that deletes
+// many files and replaces a directory as the overlayfs snapshotter and as
+// the native snapshotter represent it
+func TestNormalizeWhiteoutsAcrossSnapshotters(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	dir := func(name string) tar.Header {
+		return tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755, ModTime: mtime, Format: tar.FormatPAX}
+	}
+	file := tarEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/app/config", Mode: 0644, ModTime: mtime, Format: tar.FormatPAX}, data: "new"}
+
+	// overlayfs marks deleted files with 0/0 char devices and replaced
+	// directories with an xattr
+	opaqueDir := dir("etc/app/")
+	opaqueDir.PAXRecords = map[string]string{"SCHILY.xattr." + overlayOpaqueXattr: "y"}
+	overlay := []tarEntry{{hdr: dir("usr/")}, {hdr: dir("usr/lib/")}}
+	for i := 0; i < 50; i++ {
+		overlay = append(overlay, tarEntry{hdr: tar.Header{
+			Typeflag: tar.TypeChar,
+			Name:     fmt.Sprintf("usr/lib/lib%d.so", i),
+			ModTime:  mtime.Add(time.Duration(i) * time.Second),
+			Format:   tar.FormatPAX,
+		}})
+	}
+	overlay = append(overlay, tarEntry{hdr: dir("etc/")}, tarEntry{hdr: opaqueDir}, file)
+
+	// the native snapshotter writes AUFS whiteout files that carry the
+	// metadata of the deletion
+	native := []tarEntry{{hdr: dir("usr/")}, {hdr: dir("usr/lib/")}}
+	for i := 0; i < 50; i++ {
+		native = append(native, tarEntry{hdr: tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     fmt.Sprintf("usr/lib/.wh.lib%d.so", i),
+			Mode:     0600,
+			Uid:      1000,
+			ModTime:  time.Now(),
+			Format:   tar.FormatPAX,
+		}})
+	}
+	native = append(native, tarEntry{hdr: dir("etc/")}, tarEntry{hdr: dir("etc/app/")}, tarEntry{hdr: tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "etc/app/.wh..wh..opq",
+		Mode:     0600,
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	}}, file)
+
+	overlayLayer, nativeLayer := layerTar(t, overlay), layerTar(t, native)
+	assert.Assert(t, digest.FromBytes(overlayLayer) != digest.FromBytes(nativeLayer))
+	assert.Check(t, is.Equal(normalizedDigest(t, overlayLayer), normalizedDigest(t, nativeLayer)))
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/moby/buildkit/cache"
+	v1 "github.com/moby/buildkit/cache/remotecache/v1"
 	"github.com/moby/buildkit/util/progress"
 	"github.com/moby/buildkit/util/system"
 	digest "github.com/opencontainers/go-digest"
@@ -81,6 +82,53 @@ func patchImageConfig(dt []byte, dps []digest.Digest, history []ocispec.History)
 	return dt, errors.Wrap(err, "failed to marshal config after patch")
 }
 
+// addImageLabels sets labels in the container config of the image config dt.
+// The image store has no manifests, so annotations of the build are stored as
+// labels.
+func addImageLabels(dt []byte, labels map[string]string) ([]byte, error) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(dt, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to parse image config for labels")
+	}
+
+	c := map[string]json.RawMessage{}
+	if v, ok := m["config"]; ok && string(v) != "null" {
+		if err := json.Unmarshal(v, &c); err != nil {
+			return nil, errors.Wrap(err, "failed to parse container config")
+		}
+	}
+	l := map[string]string{}
+	if v, ok := c["Labels"]; ok && string(v) != "null" {
+		if err := json.Unmarshal(v, &l); err != nil {
+			return nil, errors.Wrap(err, "failed to parse image labels")
+		}
+	}
+	for k, v := range labels {
+		l[k] = v
+	}
+
+	var err error
+	if c["Labels"], err = json.Marshal(l); err != nil {
+		return nil, errors.Wrap(err, "failed to marshal image labels")
+	}
+	if m["config"], err = json.Marshal(c); err != nil {
+		return nil, errors.Wrap(err, "failed to marshal container config")
+	}
+	dt, err = json.Marshal(m)
+	return dt, errors.Wrap(err, "failed to marshal config after adding labels")
+}
+
+// addInlineCache embeds the inline cache records cache in the image config dt
+func addInlineCache(dt []byte, cache []byte) ([]byte, error) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(dt, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to parse image config for inline cache")
+	}
+	m[v1.ImageConfigKey] = cache
+	dt, err := json.Marshal(m)
+	return dt, errors.Wrap(err, "failed to marshal config after adding inline cache")
+}
+
 func normalizeLayersAndHistory(diffs []digest.Digest, history []ocispec.History, ref cache.ImmutableRef) ([]digest.Digest, []ocispec.History) {
 	refMeta := getRefMetadata(ref, len(diffs))
 	var historyLayers int
@@ -135,6 +183,7 @@ func normalizeLayersAndHistory(diffs []digest.Digest, history []ocispec.History,
 type refMetadata struct {
 	description string
 	createdAt   time.Time
+	labels      map[string]string
 }
 
 func getRefMetadata(ref cache.ImmutableRef, limit int) []refMetadata {
@@ -152,6 +201,7 @@ func getRefMetadata(ref cache.ImmutableRef, limit int) []refMetadata {
 		meta.description = descr
 	}
 	meta.createdAt = cache.GetCreatedAt(ref.Metadata())
+	meta.labels = cache.GetLabels(ref)
 	p := ref.Parent()
 	if p != nil {
 		defer p.Release(context.TODO())
@@ -167,9 +217,11 @@ func oneOffProgress(ctx context.Context, id string) func(err error) error {
 	}
 	pw.Write(id, st)
 	return func(err error) error {
-		// TODO: set error on status
 		now := time.Now()
 		st.Completed = &now
+		if err != nil {
+			st.Error = err.Error()
+		}
 		pw.Write(id, st)
 		pw.Close()
 		return err
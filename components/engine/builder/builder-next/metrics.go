@@ -0,0 +1,182 @@
+package buildkit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/builder/builder-next/exemplar"
+	"github.com/docker/go-metrics"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/exporter"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// exportActionsName is the name of exportActions in the Prometheus text
+// format
+const exportActionsName = "builder_buildkit_export_actions_seconds"
+
+// cacheUsageTimeout limits the time a scrape waits for the disk usage of the
+// build cache
+const cacheUsageTimeout = 10 * time.Second
+
+var (
+	activeJobs     metrics.Gauge
+	queuedVertexes metrics.Gauge
+	cacheResults   metrics.LabeledCounter
+	exportActions  metrics.LabeledTimer
+
+	cacheUsage *cacheUsageCollector
+)
+
+func init() {
+	ns := metrics.NewNamespace("builder", "buildkit", nil)
+	activeJobs = ns.NewGauge("active_jobs", "The number of builds that are being solved", metrics.Unit("jobs"))
+	queuedVertexes = ns.NewGauge("queued_vertexes", "The number of vertexes of running builds that have not started yet", metrics.Unit("vertexes"))
+	cacheResults = ns.NewLabeledCounter("cache_results", "The number of completed vertexes by whether their result was loaded from the cache", "result")
+	for _, r := range []string{"hit", "miss"} {
+		cacheResults.WithValues(r)
+	}
+	exportActions = ns.NewLabeledTimer("export_actions", "The number of seconds it takes to export the result of a build", "exporter")
+
+	cacheUsage = &cacheUsageCollector{
+		desc: ns.NewDesc("cache_storage", "The size of the build cache", metrics.Bytes, "state"),
+	}
+	ns.Add(cacheUsage)
+
+	metrics.Register(ns)
+}
+
+// cacheUsageCollector reports the size of the build cache of the builder it
+// is set for, measured on scrape
+type cacheUsageCollector struct {
+	mu   sync.Mutex
+	b    *Builder
+	desc *prometheus.Desc
+}
+
+func (c *cacheUsageCollector) set(b *Builder) {
+	c.mu.Lock()
+	c.b = b
+	c.mu.Unlock()
+}
+
+func (c *cacheUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *cacheUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	b := c.b
+	c.mu.Unlock()
+	if b == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cacheUsageTimeout)
+	defer cancel()
+	items, err := b.DiskUsage(ctx)
+	if err != nil {
+		logrus.Warnf("failed to get build cache usage for metrics: %v", err)
+		return
+	}
+	var inUse, reclaimable int64
+	for _, item := range items {
+		if item.InUse {
+			inUse += item.Size
+		} else {
+			reclaimable += item.Size
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(inUse), "in_use")
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(reclaimable), "reclaimable")
+}
+
+// vertexMetrics follows the vertexes of the status stream of a build to
+// update the queue and cache metrics
+type vertexMetrics struct {
+	queued    map[digest.Digest]struct{}
+	completed map[digest.Digest]struct{}
+}
+
+func newVertexMetrics() *vertexMetrics {
+	return &vertexMetrics{
+		queued:    map[digest.Digest]struct{}{},
+		completed: map[digest.Digest]struct{}{},
+	}
+}
+
+func (vm *vertexMetrics) update(sr *controlapi.StatusResponse) {
+	for _, v := range sr.Vertexes {
+		if _, ok := vm.completed[v.Digest]; ok {
+			continue
+		}
+		_, queued := vm.queued[v.Digest]
+		if v.Started == nil && v.Completed == nil {
+			if !queued {
+				vm.queued[v.Digest] = struct{}{}
+				queuedVertexes.Inc()
+			}
+			continue
+		}
+		if queued {
+			delete(vm.queued, v.Digest)
+			queuedVertexes.Dec()
+		}
+		if v.Completed == nil {
+			continue
+		}
+		vm.completed[v.Digest] = struct{}{}
+		if v.Error != "" {
+			continue
+		}
+		if v.Cached {
+			cacheResults.WithValues("hit").Inc()
+		} else {
+			cacheResults.WithValues("miss").Inc()
+		}
+	}
+}
+
+// done removes the vertexes that never started from the queue
+func (vm *vertexMetrics) done() {
+	queuedVertexes.Dec(float64(len(vm.queued)))
+	vm.queued = map[digest.Digest]struct{}{}
+}
+
+// instrumentedExporter times the exports of the instances of an exporter
+type instrumentedExporter struct {
+	exporter.Exporter
+	name string
+}
+
+func instrumentExporter(name string, e exporter.Exporter) exporter.Exporter {
+	return &instrumentedExporter{Exporter: e, name: name}
+}
+
+func (e *instrumentedExporter) Resolve(ctx context.Context, opt map[string]string) (exporter.ExporterInstance, error) {
+	inst, err := e.Exporter.Resolve(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedExporterInstance{ExporterInstance: inst, name: e.name}, nil
+}
+
+type instrumentedExporterInstance struct {
+	exporter.ExporterInstance
+	name string
+}
+
+// Export times the export and records the duration as an exemplar of the
+// trace of the build
+func (e *instrumentedExporterInstance) Export(ctx context.Context, src exporter.Source) (map[string]string, error) {
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		exportActions.WithValues(e.name).Update(d)
+		exemplar.Observe(ctx, exportActionsName, d.Seconds(), e.name)
+	}()
+	return e.ExporterInstance.Export(ctx, src)
+}
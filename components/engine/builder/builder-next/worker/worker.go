@@ -318,9 +318,11 @@ func oneOffProgress(ctx context.Context, id string) func(err error) error {
 	}
 	pw.Write(id, st)
 	return func(err error) error {
-		// TODO: set error on status
 		now := time.Now()
 		st.Completed = &now
+		if err != nil {
+			st.Error = err.Error()
+		}
 		pw.Write(id, st)
 		pw.Close()
 		return err
@@ -4,6 +4,7 @@ import (
 	"net"
 	"net/http"
 
+	"github.com/docker/docker/builder/builder-next/exemplar"
 	"github.com/docker/go-metrics"
 	"github.com/sirupsen/logrus"
 )
@@ -17,7 +18,9 @@ func startMetricsServer(addr string) error {
 		return err
 	}
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", metrics.Handler())
+	// scrapers accepting OpenMetrics get the exemplars linking build metrics
+	// to the traces of the builds
+	mux.Handle("/metrics", exemplar.Handler(metrics.Handler()))
 	go func() {
 		if err := http.Serve(l, mux); err != nil {
 			logrus.Errorf("serve metrics api: %s", err)